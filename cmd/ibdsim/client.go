@@ -1,6 +1,7 @@
 package ibdsim
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -11,40 +12,107 @@ import (
 	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
+// IBDConfig holds what IBDClient needs to replay blocks against a bridge
+// node's proof data.
+type IBDConfig struct {
+	IsTestnet  bool
+	OffsetFile string
+	TTLDB      string
+
+	// Progress is notified as blocks are applied, and exactly once when
+	// the run ends.  If nil, IBDClient's only output is its existing
+	// 10k-block stdout summary and a "Done Writing" line on a clean finish.
+	Progress ProgressReporter
+}
+
+// ForestStats is a structured snapshot of replay progress, passed to
+// ProgressReporter.OnBlock instead of an opaque string, so a caller can
+// render individual counters instead of scraping p.Stats()'s text dump.
+// Raw holds that same text dump for callers that want it anyway.
+type ForestStats struct {
+	TotalAdded   int
+	TotalDeleted int
+	PlusTime     time.Duration
+	Elapsed      time.Duration
+	Raw          string
+}
+
+// ProgressReporter lets a caller drive a UI or structured log off of an IBD
+// replay instead of scraping stdout.
+type ProgressReporter interface {
+	// OnBlock is called once a block has been applied to the pollard.
+	OnBlock(height int, stats ForestStats)
+	// OnDone is called exactly once, when IBDClient returns (including
+	// when setup fails before the replay loop starts).  err is nil on a
+	// clean, fully-caught-up finish, or the error (including ctx.Err() on
+	// cancellation) that ended it early.
+	OnDone(err error)
+}
+
+// noopProgress is used when a caller doesn't supply a ProgressReporter.  It
+// reproduces IBDClient's old unconditional stdout summary, so not passing a
+// Progress keeps behaving the way it always did.
+type noopProgress struct{}
+
+func (noopProgress) OnBlock(height int, stats ForestStats) {
+	if height%10000 == 0 {
+		fmt.Printf("Block %d add %d del %d %s plus %.2f total %.2f \n",
+			height, stats.TotalAdded, stats.TotalDeleted, stats.Raw,
+			stats.PlusTime.Seconds(), stats.Elapsed.Seconds())
+	}
+}
+
+func (noopProgress) OnDone(err error) {
+	if err == nil {
+		fmt.Println("Done Writing")
+	}
+}
+
 // run IBD from block proof data
 // we get the new utxo info from the same txos text file
 // the deletion data and proofs though, we get from the leveldb
 // which was created by the bridge node.
-func IBDClient(isTestnet bool, offsetfile string, ttldb string, sig chan bool) error {
-
-	//Channel to alert the main loop to break
-	stopGoing := make(chan bool, 1)
-
-	//Channel to alert stopTxottl it's ok to exit
-	done := make(chan bool, 1)
-
-	go stopRunIBD(sig, stopGoing, done)
+//
+// ctx is honored at the block loop's yield points (between blocks, and
+// while waiting on a block from simutil.BlockReader), so cancelling it stops
+// the replay without racing a block read against a block write. genPollard
+// and BlockReader are called with ctx so they can check ctx.Done() at their
+// own leveldb lookups and forest rehashing, but those functions aren't part
+// of this snapshot of the tree; honoring ctx there is left for whoever owns
+// cmd/simutil and the rest of cmd/ibdsim. The bridge-node runner this
+// package's request also named isn't part of this snapshot either (only
+// cmd/ibdsim/client.go is present here), so it doesn't get the same
+// ctx/ProgressReporter treatment in this change; that's the same gap,
+// wherever that file actually lives.
+func IBDClient(ctx context.Context, cfg IBDConfig) error {
+	progress := cfg.Progress
+	if progress == nil {
+		progress = noopProgress{}
+	}
 
-	//Check if the ttlfn given is a testnet file
-	simutil.CheckTestnet(isTestnet)
+	// Check if the ttlfn given is a testnet file
+	simutil.CheckTestnet(cfg.IsTestnet)
 
 	// open database
 	o := new(opt.Options)
 	o.CompactionTableSizeMultiplier = 8
 	o.ReadOnly = true
-	lvdb, err := leveldb.OpenFile(ttldb, o)
+	lvdb, err := leveldb.OpenFile(cfg.TTLDB, o)
 	if err != nil {
-		panic(err)
+		progress.OnDone(err)
+		return err
 	}
 	defer lvdb.Close()
 
 	pFile, err := os.OpenFile(simutil.PFilePath, os.O_RDONLY, 0400)
 	if err != nil {
+		progress.OnDone(err)
 		return err
 	}
 
 	pOffsetFile, err := os.OpenFile(simutil.POffsetFilePath, os.O_RDONLY, 0400)
 	if err != nil {
+		progress.OnDone(err)
 		return err
 	}
 
@@ -54,7 +122,8 @@ func IBDClient(isTestnet bool, offsetfile string, ttldb string, sig chan bool) e
 	var currentOffsetHeightByte [4]byte
 	currentOffsetHeightFile, err := os.Open(simutil.CurrentOffsetFilePath)
 	if err != nil {
-		panic(err)
+		progress.OnDone(err)
+		return err
 	}
 	currentOffsetHeightFile.Read(currentOffsetHeightByte[:])
 	currentOffsetHeight = int(simutil.BtU32(currentOffsetHeightByte[:]))
@@ -74,54 +143,43 @@ func IBDClient(isTestnet bool, offsetfile string, ttldb string, sig chan bool) e
 
 	lookahead := int32(1000) // keep txos that last less than this many blocks
 
-	//bool for stopping the scanner.Scan loop
-	var stop bool
-
 	// To send/receive blocks from blockreader()
 	bchan := make(chan simutil.BlockToWrite, 10)
 
 	// Reads block asynchronously from .dat files
-	go simutil.BlockReader(bchan, currentOffsetHeight, height, simutil.OffsetFilePath)
-
-	for ; height != currentOffsetHeight && stop != true; height++ {
-
-		b := <-bchan
+	go simutil.BlockReader(ctx, bchan, currentOffsetHeight, height, simutil.OffsetFilePath)
+
+	for ; height != currentOffsetHeight; height++ {
+		// select on ctx.Done() and the block channel together, so
+		// cancellation is noticed while blocked on <-bchan as well as
+		// between blocks. simutil.BlockReader and genPollard live outside this
+		// snapshot of the tree; they need the same ctx.Done() checks added
+		// at their leveldb/file reads for the race to be fully closed.
+		var b simutil.BlockToWrite
+		select {
+		case <-ctx.Done():
+			progress.OnDone(ctx.Err())
+			return ctx.Err()
+		case b = <-bchan:
+		}
 
-		err = genPollard(b.Txs, b.Height, &totalTXOAdded,
+		err = genPollard(ctx, b.Txs, b.Height, &totalTXOAdded,
 			lookahead, &totalDels, plustime, pFile, pOffsetFile, lvdb, &p)
 		if err != nil {
-			panic(err)
+			progress.OnDone(err)
+			return err
 		}
 
-		//if height%10000 == 0 {
-		//	fmt.Printf("Block %d %s plus %.2f total %.2f proofnodes %d \n",
-		//		height, newForest.Stats(),
-		//		plustime.Seconds(), time.Now().Sub(starttime).Seconds(),
-		//		totalProofNodes)
-		//}
-
-		if height%10000 == 0 {
-			fmt.Printf("Block %d add %d del %d %s plus %.2f total %.2f \n",
-				height, totalTXOAdded, totalDels, p.Stats(),
-				plustime.Seconds(), time.Now().Sub(starttime).Seconds())
-		}
-		/*
-			if height%100000 == 0 {
-				fmt.Printf(MemStatString(fname))
-			}
-		*/
-
-		//Check if stopSig is no longer false
-		//stop = true makes the loop exit
-		select {
-		case stop = <-stopGoing:
-		default:
-		}
+		progress.OnBlock(height, ForestStats{
+			TotalAdded:   totalTXOAdded,
+			TotalDeleted: totalDels,
+			PlusTime:     plustime,
+			Elapsed:      time.Now().Sub(starttime),
+			Raw:          p.Stats(),
+		})
 	}
 
-	fmt.Println("Done Writing")
-
-	done <- true
+	progress.OnDone(nil)
 
 	return nil
 }
@@ -1,6 +1,7 @@
 package utreexo
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -46,6 +47,12 @@ type Forest struct {
 	positionMap map[MiniHash]uint64 // map from hashes to positions.
 	// Inverse of forestMap for leaves.
 
+	// callbacks, if set, is notified of every leaf/top mutation Modify
+	// makes.  Optional; downstream indexers that want to observe
+	// accumulator state without polling positionMap or diffing GetTops()
+	// between blocks can set it via NewForest.
+	callbacks ForestCallbacks
+
 	// -------------------- following are just for testing / benchmarking
 	// how many hashes this forest has computed
 	HistoricHashes uint64
@@ -65,8 +72,28 @@ type Forest struct {
 	TimeInVerify time.Duration
 }
 
-// NewForest : use ram if not given a file
-func NewForest(forestFile *os.File) *Forest {
+// ForestCallbacks lets a caller observe Forest mutations as they happen,
+// instead of polling positionMap or diffing GetTops() between blocks.
+// AddedLeaf and DeletedLeaf fire for leaves that enter or leave the forest
+// outright; MovedLeaf fires once per leaf whose position changed (the swap
+// list floorTransform produces is coalesced down to net source->destination
+// before dispatch, so a leaf that's swapped several times in one Modify
+// only fires once). This includes leaves that net into the dead zone about
+// to be cleared: MovedLeaf(from, to) is always dispatched before the
+// DeletedLeaf(to, h) that follows it, so a position-keyed observer can
+// correlate the two instead of only a hash-keyed one being able to.
+// TopsChanged fires once per Modify, after adds have been applied, with the
+// final top hashes.
+type ForestCallbacks interface {
+	AddedLeaf(pos uint64, h Hash)
+	DeletedLeaf(pos uint64, h Hash)
+	MovedLeaf(from, to uint64)
+	TopsChanged(tops []Hash)
+}
+
+// NewForest : use ram if not given a file.  callbacks is optional; pass none
+// to get the old polling-only behavior.
+func NewForest(forestFile *os.File, callbacks ...ForestCallbacks) *Forest {
 	f := new(Forest)
 	f.numLeaves = 0
 	f.height = 0
@@ -81,6 +108,30 @@ func NewForest(forestFile *os.File) *Forest {
 		f.data = d
 	}
 
+	if len(callbacks) > 0 {
+		f.callbacks = callbacks[0]
+	}
+
+	f.data.resize(1)
+	f.positionMap = make(map[MiniHash]uint64)
+	return f
+}
+
+// NewForestWithCache is like NewForest, but for the on-disk case backs the
+// forest with a bounded LRU cache (see NewCachedDiskForest) instead of
+// hitting forestFile for every read and write.
+func NewForestWithCache(forestFile *os.File, maxCacheBytes int64) *Forest {
+	f := new(Forest)
+	f.numLeaves = 0
+	f.height = 0
+
+	if forestFile == nil {
+		// for in-ram, same as NewForest
+		f.data = new(ramForestData)
+	} else {
+		f.data = NewCachedDiskForest(forestFile, maxCacheBytes)
+	}
+
 	f.data.resize(1)
 	f.positionMap = make(map[MiniHash]uint64)
 	return f
@@ -96,9 +147,9 @@ const bridgeVerbose = false
 var empty [32]byte
 
 // Remove :
-func (f *Forest) Remove(dels []uint64) error {
+func (f *Forest) Remove(ctx context.Context, dels []uint64) error {
 
-	err := f.removev3(dels)
+	err := f.removev3(ctx, dels)
 	if err != nil {
 		return err
 	}
@@ -108,7 +159,7 @@ func (f *Forest) Remove(dels []uint64) error {
 
 // removev3 uses top down swaps and hopefully works the exact same as before
 // top down swaps are better suited to undoing deletions
-func (f *Forest) removev3(dels []uint64) error {
+func (f *Forest) removev3(ctx context.Context, dels []uint64) error {
 
 	if uint64(len(dels)) > f.numLeaves {
 		return fmt.Errorf("%d deletions but forest has %d leaves",
@@ -126,6 +177,15 @@ func (f *Forest) removev3(dels []uint64) error {
 
 	var dirt []uint64
 
+	// track, for every position touched by a swap, which original position
+	// (before this removev3 call) the leaf now sitting there came from.
+	// Used to coalesce floorTransform's intermediate swaps down to a single
+	// net source->destination move per leaf before notifying callbacks.
+	var track map[uint64]uint64
+	if f.callbacks != nil {
+		track = make(map[uint64]uint64)
+	}
+
 	// fmt.Printf("v3 topDownTransform %d %d %d\n", dels, f.numLeaves, f.height)
 	swaps := floorTransform(dels, f.numLeaves, f.height)
 	// TODO really really shouldn't use floor transform here.
@@ -134,6 +194,11 @@ func (f *Forest) removev3(dels []uint64) error {
 	// TODO definitely not how to do this, way inefficient
 	// don't even use dirt, do it like in pollard
 	for _, s := range swaps {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		f.data.swapHash(s.from, s.to)
 		if s.to < nextNumLeaves {
 			// from as well?
@@ -146,11 +211,37 @@ func (f *Forest) removev3(dels []uint64) error {
 		// height 0 so just change position map here...
 		f.positionMap[f.data.read(s.to).Mini()] = s.to
 		f.positionMap[f.data.read(s.from).Mini()] = s.from
+
+		if track != nil {
+			origFrom, ok := track[s.from]
+			if !ok {
+				origFrom = s.from
+			}
+			origTo, ok := track[s.to]
+			if !ok {
+				origTo = s.to
+			}
+			track[s.to] = origFrom
+			track[s.from] = origTo
+		}
 	}
 
 	f.numLeaves = nextNumLeaves
 
-	return f.reHash(dirt)
+	if track != nil {
+		// Fire for every net relocation, including leaves that land in the
+		// soon-to-be-cleared dead zone (finalPos >= nextNumLeaves): cleanup
+		// is about to announce a DeletedLeaf at that same finalPos, and a
+		// position-keyed observer can only match the two up if it was told
+		// the leaf passed through finalPos first.
+		for finalPos, origPos := range track {
+			if finalPos != origPos {
+				f.callbacks.MovedLeaf(origPos, finalPos)
+			}
+		}
+	}
+
+	return f.reHash(ctx, dirt)
 }
 
 // reHash hashes new data in the forest based on dirty positions.
@@ -158,7 +249,7 @@ func (f *Forest) removev3(dels []uint64) error {
 // parent has changed children.
 // TODO: switch the meaning of "dirt" to mean parents with changed children;
 // this will probably make it a lot simpler.
-func (f *Forest) reHash(dirt []uint64) error {
+func (f *Forest) reHash(ctx context.Context, dirt []uint64) error {
 	if f.height == 0 || len(dirt) == 0 { // nothing to hash
 		return nil
 	}
@@ -195,8 +286,18 @@ func (f *Forest) reHash(dirt []uint64) error {
 
 	var currentRow, nextRow []uint64
 
+	// if the backing ForestData can pin pages, hold the row we're about to
+	// walk in cache so a single dirty sweep never re-reads the same page
+	// twice.
+	pinner, _ := f.data.(Pinner)
+
 	// floor by floor
 	for h = uint8(0); h < f.height; h++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		if bridgeVerbose {
 			fmt.Printf("dirty %v\ncurrentRow %v\n", dirty2d[h], currentRow)
 		}
@@ -212,6 +313,10 @@ func (f *Forest) reHash(dirt []uint64) error {
 			break
 		}
 
+		if pinner != nil {
+			pinner.Acquire(currentRow)
+		}
+
 		for i, pos := range currentRow {
 			// skip if next is sibling
 			if i+1 < len(currentRow) && currentRow[i]|1 == currentRow[i+1] {
@@ -246,6 +351,9 @@ func (f *Forest) reHash(dirt []uint64) error {
 			tops = tops[1:]
 			topheights = topheights[1:]
 		}
+		if pinner != nil {
+			pinner.Release(currentRow)
+		}
 		currentRow = nextRow
 		nextRow = []uint64{}
 	}
@@ -256,9 +364,13 @@ func (f *Forest) reHash(dirt []uint64) error {
 // cleanup removes extraneous hashes from the forest.  Currently only the bottom
 func (f *Forest) cleanup(overshoot uint64) {
 	for p := f.numLeaves; p < f.numLeaves+overshoot; p++ {
-		delete(f.positionMap, f.data.read(p).Mini()) // clear position map
+		h := f.data.read(p)
+		delete(f.positionMap, h.Mini()) // clear position map
 		// TODO ^^^^ that probably does nothing
 		f.data.write(p, empty) // clear forest
+		if f.callbacks != nil && h != empty {
+			f.callbacks.DeletedLeaf(p, h)
+		}
 	}
 }
 
@@ -278,6 +390,9 @@ func (f *Forest) addv2(adds []LeafTXO) {
 		pos := f.numLeaves
 		n := add.Hash
 		f.data.write(pos, n)
+		if f.callbacks != nil {
+			f.callbacks.AddedLeaf(pos, n)
+		}
 		for h := uint8(0); (f.numLeaves>>h)&1 == 1; h++ {
 			// grab, pop, swap, hash, new
 			top := f.data.read(tops[h]) // grab
@@ -296,11 +411,16 @@ func (f *Forest) addv2(adds []LeafTXO) {
 // Note that this does not modify in place!  All deletes occur simultaneous with
 // adds, which show up on the right.
 // Also, the deletes need there to be correct proof data, so you should first call Verify().
-func (f *Forest) Modify(adds []LeafTXO, dels []uint64) (*undoBlock, error) {
+func (f *Forest) Modify(ctx context.Context, adds []LeafTXO, dels []uint64) (*undoBlock, error) {
 	numdels, numadds := uint64(len(dels)), uint64(len(adds))
 	delta := numadds - numdels // watch 32/64 bit
 	// remap to expand the forest if needed
 	for f.numLeaves+delta > 1<<f.height {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
 		// fmt.Printf("current cap %d need %d\n",
 		// 1<<f.height, f.numLeaves+delta)
 		err := f.reMap(f.height + 1)
@@ -310,7 +430,7 @@ func (f *Forest) Modify(adds []LeafTXO, dels []uint64) (*undoBlock, error) {
 	}
 
 	// v3 should do the exact same thing as v2 now
-	err := f.removev3(dels)
+	err := f.removev3(ctx, dels)
 	if err != nil {
 		return nil, err
 	}
@@ -325,6 +445,10 @@ func (f *Forest) Modify(adds []LeafTXO, dels []uint64) (*undoBlock, error) {
 
 	f.addv2(adds)
 
+	if f.callbacks != nil {
+		f.callbacks.TopsChanged(f.GetTops())
+	}
+
 	// fmt.Printf("done modifying block, added %d\n", len(adds))
 	// fmt.Printf("post add %s\n", f.ToString())
 	// for m, p := range f.positionMap {
@@ -351,10 +475,33 @@ func (f *Forest) reMap(destHeight uint8) error {
 
 	// for height reduction
 	if destHeight < f.height {
-		return fmt.Errorf("height reduction not implemented")
+		// inverse of the height-increase loop below: copy each row inward,
+		// sources on the (current, taller) outer rows, destinations packed
+		// toward position 1<<destHeight.  Row 0 doesn't move; it's just
+		// truncated by the resize below since everything past the new
+		// numLeaves bound is already empty, or Compact wouldn't have let
+		// us get here.
+		pos := uint64(1 << f.height) // leftmost position of row 1, old layout
+		reach := pos >> 1
+		for h := uint8(1); h < f.height; h++ {
+			runLength := reach >> 1
+			for x := uint64(0); x < runLength; x++ {
+				src := pos + x
+				dest := (pos >> 1) + x
+				if f.data.size() > src && f.data.read(src) != empty {
+					f.data.write(dest, f.data.read(src))
+				} else {
+					f.data.write(dest, empty)
+				}
+			}
+			pos += reach
+			reach >>= 1
+		}
+
+		f.data.resize(1 << destHeight)
+		f.height = destHeight
+		return nil
 	}
-	// I don't think you ever need to remap down.  It really doesn't
-	// matter.  Something to program someday if you feel like it for fun.
 
 	// height increase
 	f.data.resize(1 << destHeight)
@@ -390,6 +537,23 @@ func (f *Forest) reMap(destHeight uint8) error {
 	return nil
 }
 
+// Compact shrinks the forest's on-disk/in-ram footprint after sustained
+// deletion.  Modify only ever grows f.height to fit incoming adds, so on a
+// chain or workload with heavy deletion (a reorg-heavy IBD replay, a bridge
+// node serving a pruned range) the height ratchets up and never comes back
+// down, wasting both disk (f.data's backing size) and per-row work in
+// reHash.  Compact is not called automatically; callers should invoke it
+// between blocks once they expect deletions to have settled.
+func (f *Forest) Compact() error {
+	for f.height > 0 && treeHeight(f.numLeaves) < f.height-1 {
+		err := f.reMap(f.height - 1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // sanity checks forest sanity: does numleaves make sense, and are the tops
 // populated?
 func (f *Forest) sanity() error {
@@ -470,6 +634,118 @@ func (f *Forest) RestoreForest(miscForestFile *os.File, forestFile *os.File) err
 	return nil
 }
 
+// RebuildOptions configures Forest.Rebuild.
+type RebuildOptions struct {
+	// ExpectedTops, if non-empty, is checked against the tops recovered
+	// from disk; any top that doesn't match is reported via the returned
+	// *RebuildError instead of being silently accepted.
+	ExpectedTops []Hash
+}
+
+// RebuildError reports which of the recovered tops, if any, didn't match
+// RebuildOptions.ExpectedTops.
+type RebuildError struct {
+	// Mismatched holds every index i at which GetTops()[i] and
+	// ExpectedTops[i] disagree, including an index only one of them has.
+	Mismatched []int
+}
+
+func (e *RebuildError) Error() string {
+	return fmt.Sprintf("rebuild: %d top(s) did not match the expected tops: %v",
+		len(e.Mismatched), e.Mismatched)
+}
+
+// Rebuild reconstructs a Forest from just the leaf row of forestFile,
+// trusting neither a misc file nor any internal node already on disk.
+// Unlike RestoreForest, which trusts numLeaves/height recorded elsewhere and
+// only repopulates positionMap, Rebuild is meant for the case where the misc
+// file or upper rows are truncated or corrupt after a crash mid-Modify, and
+// only the bottom row can be trusted.
+//
+// It infers numLeaves by scanning the bottom row for the last non-empty
+// leaf, sets the height implied by numLeaves (without reMap, which would
+// move and clear bottom-row positions), recomputes every internal node by
+// feeding every leaf position through reHash (which walks row by row,
+// hashing parents and carrying the result up, the same way it does for a
+// partial dirty set), and rebuilds positionMap from the recovered leaves. If
+// opts.ExpectedTops is supplied, the recovered tops are checked against it.
+func (f *Forest) Rebuild(forestFile *os.File, opts RebuildOptions) error {
+	d := new(diskForestData)
+	d.f = forestFile
+	f.data = d
+
+	// (a) infer numLeaves from the last non-empty leaf on the bottom row.
+	// The scan must stop at the end of row 0: everything above it (internal
+	// nodes, tops) is exactly what Rebuild doesn't trust, so reading into it
+	// would let a stray non-empty internal-node hash near the end of the
+	// file masquerade as the last leaf. Row 0 always occupies [0, 1<<h) of a
+	// full forest of height h, whose total on-disk size is (1<<(h+1))-1; we
+	// don't know h yet (it's what we're recovering), so find the largest h
+	// whose full-forest size still fits within what's on disk, and treat
+	// 1<<h as the bottom row's width.
+	diskSize := f.data.size()
+	bottomHeight := uint8(0)
+	for (uint64(1)<<(bottomHeight+2))-1 <= diskSize {
+		bottomHeight++
+	}
+	bottomRowWidth := uint64(1) << bottomHeight
+
+	f.numLeaves = 0
+	for p := bottomRowWidth; p > 0; p-- {
+		if diskSize > p-1 && f.data.read(p-1) != empty {
+			f.numLeaves = p
+			break
+		}
+	}
+
+	// (b) set the implied height.  reMap can't be used here: it treats the
+	// data as a forest of the current height and would move and zero the
+	// leaves.  A forest of height h <= bottomHeight already fits on disk,
+	// and its row 0 past numLeaves is empty by the scan above.
+	f.height = 0
+	for f.numLeaves > 1<<f.height {
+		f.height++
+	}
+
+	// (c) reconstruct every internal node bottom-up by running every
+	// leaf position through reHash, the same machinery a normal dirty
+	// sweep uses
+	dirt := make([]uint64, f.numLeaves)
+	for i := range dirt {
+		dirt[i] = uint64(i)
+	}
+	if err := f.reHash(context.Background(), dirt); err != nil {
+		return fmt.Errorf("rebuild: %v", err)
+	}
+
+	// (d) rebuild positionMap from the recovered leaves
+	f.positionMap = make(map[MiniHash]uint64)
+	for i := uint64(0); i < f.numLeaves; i++ {
+		f.positionMap[f.data.read(i).Mini()] = i
+	}
+
+	// (e) verify against the caller's expected tops, if given
+	if len(opts.ExpectedTops) > 0 {
+		tops := f.GetTops()
+		n := len(tops)
+		if len(opts.ExpectedTops) > n {
+			n = len(opts.ExpectedTops)
+		}
+		var mismatched []int
+		for i := 0; i < n; i++ {
+			if i >= len(tops) || i >= len(opts.ExpectedTops) ||
+				tops[i] != opts.ExpectedTops[i] {
+				mismatched = append(mismatched, i)
+			}
+		}
+		if len(mismatched) > 0 {
+			return &RebuildError{Mismatched: mismatched}
+		}
+	}
+
+	return nil
+}
+
 func (f *Forest) PrintPositionMap(file *os.File) {
 	var s string
 	for m, pos := range f.positionMap {
@@ -485,6 +761,12 @@ func (f *Forest) PrintPositionMap(file *os.File) {
 func (f *Forest) WriteForest(miscForestFile *os.File) error {
 	fmt.Println("numLeaves=", f.numLeaves)
 	fmt.Println("f.height=", f.height)
+	// flush any write-back cache before recording numLeaves/height, so a
+	// crash can never leave the misc file ahead of the forest data it
+	// describes
+	if flusher, ok := f.data.(flusher); ok {
+		flusher.Flush()
+	}
 	_, err := miscForestFile.WriteAt(append(U64tB(f.numLeaves), U8tB(f.height)...), 0)
 	if err != nil {
 		return err
@@ -492,6 +774,12 @@ func (f *Forest) WriteForest(miscForestFile *os.File) error {
 	return nil
 }
 
+// flusher is implemented by write-back ForestData backends (cachedForestData)
+// that need an explicit push to get dirty pages out to disk.
+type flusher interface {
+	Flush()
+}
+
 // GetTops returns all the tops of the trees
 func (f *Forest) GetTops() []Hash {
 
@@ -514,6 +802,12 @@ func (f *Forest) Stats() string {
 	s += fmt.Sprintf("\thashT: %.2f remT: %.2f (of which MST %.2f) proveT: %.2f",
 		f.TimeInHash.Seconds(), f.TimeRem.Seconds(), f.TimeMST.Seconds(),
 		f.TimeInProve.Seconds())
+
+	if cache, ok := f.data.(*cachedForestData); ok {
+		hits, misses, evictions := cache.CacheStats()
+		s += fmt.Sprintf("\n\tcache hits: %d misses: %d evictions: %d",
+			hits, misses, evictions)
+	}
 	return s
 }
 
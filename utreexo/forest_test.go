@@ -0,0 +1,75 @@
+package utreexo
+
+import (
+	"context"
+	"testing"
+)
+
+// TestForestCompact grows a forest past several height boundaries, deletes
+// all but a few leaves, then compacts it and checks that the accumulator's
+// logical state (tops and positionMap) didn't move, only its on-disk/in-ram
+// footprint did.
+func TestForestCompact(t *testing.T) {
+	f := NewForest(nil)
+	ctx := context.Background()
+
+	const numLeaves = 64
+	adds := make([]LeafTXO, numLeaves)
+	for i := range adds {
+		var h Hash
+		h[0] = byte(i + 1)
+		adds[i] = LeafTXO{Hash: h}
+	}
+	if _, err := f.Modify(ctx, adds, nil); err != nil {
+		t.Fatalf("adding %d leaves: %v", numLeaves, err)
+	}
+
+	grownHeight := f.height
+	if grownHeight == 0 {
+		t.Fatalf("expected forest to have grown past height 0, got %d", grownHeight)
+	}
+
+	// delete all but the first few leaves
+	const keep = 3
+	var dels []uint64
+	for i := uint64(keep); i < numLeaves; i++ {
+		dels = append(dels, i)
+	}
+	if _, err := f.Modify(ctx, nil, dels); err != nil {
+		t.Fatalf("deleting down to %d leaves: %v", keep, err)
+	}
+
+	wantTops := f.GetTops()
+	wantPosMap := make(map[MiniHash]uint64, len(f.positionMap))
+	for k, v := range f.positionMap {
+		wantPosMap[k] = v
+	}
+
+	if err := f.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+
+	if f.height >= grownHeight {
+		t.Fatalf("compact didn't shrink height: still %d (was %d)", f.height, grownHeight)
+	}
+
+	gotTops := f.GetTops()
+	if len(gotTops) != len(wantTops) {
+		t.Fatalf("top count changed: got %d want %d", len(gotTops), len(wantTops))
+	}
+	for i := range wantTops {
+		if gotTops[i] != wantTops[i] {
+			t.Errorf("top %d changed across compact: got %x want %x", i, gotTops[i], wantTops[i])
+		}
+	}
+
+	if len(f.positionMap) != len(wantPosMap) {
+		t.Fatalf("positionMap size changed: got %d want %d", len(f.positionMap), len(wantPosMap))
+	}
+	for k, want := range wantPosMap {
+		got, ok := f.positionMap[k]
+		if !ok || got != want {
+			t.Errorf("positionMap[%x] = %d, want %d", k, got, want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package utreexo
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// hashesPerPage is how many Hashes make up one cached page.  128 * 32 bytes
+// == 4KiB, which keeps a page aligned with a typical disk block.
+const hashesPerPage = 128
+
+// hashSize is the on-disk width of a Hash, used to turn a page index into a
+// byte range for the bulk ReadAt/WriteAt in fillPage/flushPage.
+var hashSize = uint64(len(Hash{}))
+
+// page holds the hashes for hashesPerPage contiguous positions starting at
+// idx*hashesPerPage, plus whether any of them have been written since the
+// page was pulled in from disk.
+type page struct {
+	idx   uint64
+	h     [hashesPerPage]Hash
+	dirty bool
+	pins  int
+}
+
+// cacheStats tracks how well a cachedForestData's LRU is doing.
+type cacheStats struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// cachedForestData is a ForestData that wraps a diskForestData with a
+// bounded, evictable LRU of fixed-size pages, so that IBDClient-scale
+// forests don't pay a read/write syscall per hash.  Writes are write-back:
+// a dirty page is only flushed to the underlying file when it's evicted or
+// when Flush is called explicitly.
+type cachedForestData struct {
+	disk *diskForestData
+
+	mtx      sync.Mutex
+	maxPages int
+	byIdx    map[uint64]*list.Element // page idx -> element in lru
+	lru      *list.List               // front == most recently used
+
+	stats cacheStats
+}
+
+// NewCachedDiskForest returns a ForestData backed by file, caching up to
+// maxBytes worth of the hottest pages in RAM instead of hitting the file
+// for every read and write.
+func NewCachedDiskForest(file *os.File, maxBytes int64) ForestData {
+	d := new(diskForestData)
+	d.f = file
+
+	maxPages := int(maxBytes / (hashesPerPage * int64(len(Hash{}))))
+	if maxPages < 1 {
+		maxPages = 1
+	}
+
+	return &cachedForestData{
+		disk:     d,
+		maxPages: maxPages,
+		byIdx:    make(map[uint64]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func pageIdx(pos uint64) (idx uint64, off uint64) {
+	return pos / hashesPerPage, pos % hashesPerPage
+}
+
+// getPage returns the page covering pos, loading it from disk and possibly
+// evicting an unrelated page if it isn't already cached.  Caller must hold
+// c.mtx.
+func (c *cachedForestData) getPage(pos uint64) *page {
+	idx, _ := pageIdx(pos)
+
+	if el, ok := c.byIdx[idx]; ok {
+		c.lru.MoveToFront(el)
+		c.stats.hits++
+		return el.Value.(*page)
+	}
+
+	c.stats.misses++
+	p := &page{idx: idx}
+	c.fillPage(p)
+
+	c.evictIfNeeded()
+	c.byIdx[idx] = c.lru.PushFront(p)
+	return p
+}
+
+// dropStale removes every cached page that could hold data no longer valid
+// at newSize, without flushing it: a page straddling or past newSize may
+// have been correctly overwritten by resize's caller already (reMap writes
+// through the cache), but any page that wasn't touched still holds
+// pre-resize bytes.  A later read at the same index would otherwise hit
+// that stale page instead of re-reading the freshly resized (and, on
+// growth, zero-filled) file underneath.  Caller must hold c.mtx.
+func (c *cachedForestData) dropStale(newSize uint64) {
+	firstStale := newSize / hashesPerPage
+	var next *list.Element
+	for el := c.lru.Front(); el != nil; el = next {
+		next = el.Next()
+		p := el.Value.(*page)
+		if p.idx >= firstStale {
+			c.lru.Remove(el)
+			delete(c.byIdx, p.idx)
+		}
+	}
+}
+
+// evictIfNeeded drops least-recently-used, unpinned pages until the cache
+// is back under its budget.  Caller must hold c.mtx.
+func (c *cachedForestData) evictIfNeeded() {
+	for c.lru.Len() >= c.maxPages {
+		el := c.lru.Back()
+		for el != nil && el.Value.(*page).pins > 0 {
+			el = el.Prev()
+		}
+		if el == nil {
+			// everything is pinned; over budget until a release happens
+			return
+		}
+		p := el.Value.(*page)
+		c.flushPage(p)
+		c.lru.Remove(el)
+		delete(c.byIdx, p.idx)
+		c.stats.evictions++
+	}
+}
+
+// fillPage bulk-reads the bytes backing page p straight from the
+// underlying file in a single ReadAt, instead of going through disk.read
+// hashesPerPage times -- a cold miss on a 4KiB page used to cost up to 128
+// syscalls; this costs one.  Positions past the end of the file are left
+// zeroed, same as disk.read would return for them.  Caller must hold c.mtx.
+func (c *cachedForestData) fillPage(p *page) {
+	diskSize := c.disk.size()
+	base := p.idx * hashesPerPage
+	if base >= diskSize {
+		return
+	}
+	n := uint64(hashesPerPage)
+	if base+n > diskSize {
+		n = diskSize - base
+	}
+	buf := make([]byte, n*hashSize)
+	c.disk.f.ReadAt(buf, int64(base*hashSize))
+	for i := uint64(0); i < n; i++ {
+		copy(p.h[i][:], buf[i*hashSize:(i+1)*hashSize])
+	}
+}
+
+// flushPage writes a dirty page back to disk in a single WriteAt instead of
+// hashesPerPage separate disk.write calls.  Caller must hold c.mtx.
+func (c *cachedForestData) flushPage(p *page) {
+	if !p.dirty {
+		return
+	}
+	diskSize := c.disk.size()
+	base := p.idx * hashesPerPage
+	if base >= diskSize {
+		p.dirty = false
+		return
+	}
+	n := uint64(hashesPerPage)
+	if base+n > diskSize {
+		n = diskSize - base
+	}
+	buf := make([]byte, n*hashSize)
+	for i := uint64(0); i < n; i++ {
+		copy(buf[i*hashSize:(i+1)*hashSize], p.h[i][:])
+	}
+	c.disk.f.WriteAt(buf, int64(base*hashSize))
+	p.dirty = false
+}
+
+func (c *cachedForestData) read(pos uint64) Hash {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	_, off := pageIdx(pos)
+	return c.getPage(pos).h[off]
+}
+
+func (c *cachedForestData) write(pos uint64, h Hash) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	_, off := pageIdx(pos)
+	p := c.getPage(pos)
+	p.h[off] = h
+	p.dirty = true
+}
+
+func (c *cachedForestData) swapHash(a, b uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	_, aOff := pageIdx(a)
+	_, bOff := pageIdx(b)
+	// pin a's page before loading b: if a and b land on different pages and
+	// the cache is at capacity (it always is when maxPages == 1),
+	// getPage(b) can itself evict a's page out from under us, orphaning the
+	// pointer we already hold and silently dropping the swap.
+	pa := c.getPage(a)
+	pa.pins++
+	pb := c.getPage(b)
+	pa.h[aOff], pb.h[bOff] = pb.h[bOff], pa.h[aOff]
+	pa.dirty, pb.dirty = true, true
+	pa.pins--
+}
+
+func (c *cachedForestData) resize(newSize uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.flushLocked()
+	c.disk.resize(newSize)
+	c.dropStale(newSize)
+}
+
+func (c *cachedForestData) size() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.disk.size()
+}
+
+// flushLocked is Flush's body, factored out so resize (which already holds
+// c.mtx) can call it directly instead of through the public, self-locking
+// Flush -- sync.Mutex isn't reentrant.  Caller must hold c.mtx.
+func (c *cachedForestData) flushLocked() {
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		c.flushPage(el.Value.(*page))
+	}
+}
+
+// Flush writes every dirty cached page back to the underlying file.  It's
+// meant to be called from WriteForest, right before the misc file (which
+// records numLeaves/height) is written, so a crash never leaves the misc
+// file ahead of the forest data it describes.
+func (c *cachedForestData) Flush() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.flushLocked()
+}
+
+// Acquire pins the pages covering positions in cache so a tight read/write
+// loop (a reHash row, say) doesn't evict and re-load the same page twice.
+// It satisfies the Pinner interface.
+func (c *cachedForestData) Acquire(positions []uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, pos := range positions {
+		c.getPage(pos).pins++
+	}
+}
+
+// Release undoes a matching Acquire, making the pages eligible for eviction
+// again.  It satisfies the Pinner interface.
+func (c *cachedForestData) Release(positions []uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, pos := range positions {
+		idx, _ := pageIdx(pos)
+		if el, ok := c.byIdx[idx]; ok {
+			if p := el.Value.(*page); p.pins > 0 {
+				p.pins--
+			}
+		}
+	}
+}
+
+// CacheStats reports how the LRU has performed so far.
+func (c *cachedForestData) CacheStats() (hits, misses, evictions uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.stats.hits, c.stats.misses, c.stats.evictions
+}
+
+// Pinner is implemented by ForestData backends that benefit from having a
+// batch of positions held in cache across a tight read/write loop, such as
+// cachedForestData during a reHash row sweep.
+type Pinner interface {
+	Acquire(positions []uint64)
+	Release(positions []uint64)
+}
@@ -0,0 +1,121 @@
+package utreexo
+
+import (
+	"container/list"
+	"os"
+	"testing"
+)
+
+// newTempCachedForest returns a cachedForestData backed by a scratch file
+// that's removed when the test ends.
+func newTempCachedForest(t *testing.T, maxBytes int64) *cachedForestData {
+	t.Helper()
+	f, err := os.CreateTemp("", "forestdata_cache_test")
+	if err != nil {
+		t.Fatalf("temp file: %v", err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+	return NewCachedDiskForest(f, maxBytes).(*cachedForestData)
+}
+
+// TestCachedForestDataSwapAcrossPagesTinyCache is a regression test for the
+// swapHash bug fixed in 1e3e0f1: with room for exactly one page, swapping
+// two positions on different pages used to let the second getPage() evict
+// the first page out from under the in-progress swap.
+func TestCachedForestDataSwapAcrossPagesTinyCache(t *testing.T) {
+	c := newTempCachedForest(t, int64(hashesPerPage)*int64(hashSize))
+	if c.maxPages != 1 {
+		t.Fatalf("expected maxPages 1 for a one-page cache, got %d", c.maxPages)
+	}
+	c.resize(3 * hashesPerPage)
+
+	var ha, hb Hash
+	ha[0], hb[0] = 1, 2
+	posA, posB := uint64(0), uint64(hashesPerPage) // different pages
+
+	c.write(posA, ha)
+	c.write(posB, hb)
+	c.swapHash(posA, posB)
+
+	if got := c.read(posA); got != hb {
+		t.Errorf("read(posA) = %x, want %x", got, hb)
+	}
+	if got := c.read(posB); got != ha {
+		t.Errorf("read(posB) = %x, want %x", got, ha)
+	}
+}
+
+// TestCachedForestDataFlushPersists checks that Flush writes dirty pages
+// through to the underlying file, not just somewhere a fresh cache over the
+// same file can no longer see them.
+func TestCachedForestDataFlushPersists(t *testing.T) {
+	c := newTempCachedForest(t, 1<<20)
+	c.resize(hashesPerPage)
+
+	var h Hash
+	h[0] = 7
+	c.write(5, h)
+	c.Flush()
+
+	fresh := &cachedForestData{
+		disk:     c.disk,
+		maxPages: c.maxPages,
+		byIdx:    make(map[uint64]*list.Element),
+		lru:      list.New(),
+	}
+	if got := fresh.read(5); got != h {
+		t.Errorf("read after Flush through a fresh cache = %x, want %x", got, h)
+	}
+}
+
+// TestCachedForestDataShrinkThenGrowDropsStalePage is a regression test for
+// the resize bug that chunk0-1's review caught: Compact shrinking the
+// forest used to leave a cache-resident page for the truncated-off range
+// untouched, so growing back past that page boundary would serve stale
+// pre-shrink bytes on a cache hit instead of the zero-filled bytes the
+// freshly resized file actually holds there.
+func TestCachedForestDataShrinkThenGrowDropsStalePage(t *testing.T) {
+	c := newTempCachedForest(t, 1<<20) // big enough that nothing naturally evicts
+	c.resize(4 * hashesPerPage)
+
+	pos := uint64(3 * hashesPerPage) // lives on the page that shrink will drop
+	var h Hash
+	h[0] = 9
+	c.write(pos, h)
+	c.Flush()
+
+	c.resize(1 * hashesPerPage) // shrink past pos's page
+	c.resize(4 * hashesPerPage) // grow back across it
+
+	var zero Hash
+	if got := c.read(pos); got != zero {
+		t.Errorf("read(pos) after shrink+grow = %x, want zero (stale page resurfaced)", got)
+	}
+}
+
+// TestCachedForestDataStats checks that hits/misses/evictions move the way
+// a tiny cache forced to thrash should.
+func TestCachedForestDataStats(t *testing.T) {
+	c := newTempCachedForest(t, int64(hashesPerPage)*int64(hashSize))
+	c.resize(3 * hashesPerPage)
+
+	var h Hash
+	c.write(0, h)               // miss: loads page 0
+	c.write(0, h)               // hit: page 0 still cached
+	c.write(2*hashesPerPage, h) // miss: loads page 2, evicting page 0
+	c.read(0)                   // miss again: page 0 was evicted
+
+	hits, misses, evictions := c.CacheStats()
+	if hits == 0 {
+		t.Errorf("expected at least one hit, got %d", hits)
+	}
+	if misses < 3 {
+		t.Errorf("expected at least 3 misses, got %d", misses)
+	}
+	if evictions == 0 {
+		t.Errorf("expected at least one eviction, got %d", evictions)
+	}
+}